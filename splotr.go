@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+
+	"github.com/sigsegv7/splotr/decoder"
 )
 
 //
@@ -101,11 +108,984 @@ type Mp3FrameHeader struct {
 }
 
 type Mp3File struct {
-	Path            Mp3Path  // Path of .mp3 file
-	DurationMin     Mp3Dur   // Duration in min
-	DurationSec     Mp3Dur   // Duration in sec
-	Size            Mp3Size  // Size of file in bytes
-	Contents        []byte   // Raw binary contents
+	Path            Mp3Path    // Path of .mp3 file
+	DurationMin     Mp3Dur     // Duration in min
+	DurationSec     Mp3Dur     // Duration in sec
+	Size            Mp3Size    // Size of file in bytes
+	Contents        []byte     // Raw binary contents
+	Tags            Mp3Tags    // ID3v1/ID3v2 metadata, if any was found
+	vbr             *VBRHeader // Xing/Info/VBRI header, if one was found
+}
+
+// Tag looks up an arbitrary ID3v2 frame by its 4-character frame ID
+// (e.g. "TIT2", "TPE1"). It returns false if the file had no ID3v2
+// tag or the frame wasn't present. ID3v1-only files never populate
+// this, since ID3v1 has no frame IDs of its own.
+func (f *Mp3File) Tag(id string) (string, bool) {
+	v, ok := f.Tags.frames[id]
+	return v, ok
+}
+
+//
+// Mp3Stream walks an elementary MP3 stream one frame header at a
+// time via Next(). It is responsible for everything DeserializeFrame()
+// alone cannot be: finding where the first real frame actually starts
+// (most files open with an ID3v2 tag, not a frame) and where the last
+// one actually ends (many files close with an ID3v1 or APEv2 tag).
+//
+// @SyncSeekWindow
+//     Next() will not scan forever looking for a sync word; if a
+//     bitstream is corrupt it bails out after this many bytes so a
+//     bad file can't hang the caller.
+//
+type Mp3Stream struct {
+	buf            []byte // Backing bytes for the whole elementary stream
+	pos            int    // Current scan offset into buf
+	end            int    // Offset of the first trailing tag byte (exclusive)
+	lastFrameStart int    // Start offset of the last frame returned, or -1
+	lastFrameSize  int    // FrameSize() of the last frame returned
+	StrictCRC      bool   // If set, Next() reports ErrCRCMismatch instead of resyncing past it
+}
+
+const SyncSeekWindow = 4096 // Bounded sync-seek window, in bytes
+
+var (
+	ErrSyncNotFound = errors.New("splotr: no frame sync found within sync-seek window")
+
+	// errNotFrame is an internal sentinel meaning "no valid header at
+	// this offset, keep looking" — as opposed to ErrCRCMismatch, which
+	// means a header was found but rejected under StrictCRC.
+	errNotFrame = errors.New("splotr: no frame header at this offset")
+)
+
+// NewMp3Stream reads all of r into memory and prepares it for frame
+// scanning, skipping a leading ID3v2 header and excluding a trailing
+// ID3v1/APEv2 tag (if present) from the scan range.
+func NewMp3Stream(r io.Reader) (*Mp3Stream, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Mp3Stream)
+	s.buf = data
+	s.pos = skipId3v2(data)
+	s.end = trailingTagStart(data)
+	s.lastFrameStart = -1
+	return s, nil
+}
+
+// Next returns the next frame header. Once a frame has been found,
+// subsequent calls first try to jump straight to lastFrameStart +
+// lastFrameSize, which is O(1) per frame for constant-bitrate files;
+// if that offset doesn't hold a valid header (free-format bitrate, a
+// dropped byte, a corrupt frame) it falls back to a bounded sync-seek
+// resync, rejecting any candidate whose bitrate, sample-rate or layer
+// fields are reserved. It returns io.EOF once the scan reaches the
+// trailing-tag boundary, or ErrSyncNotFound if no sync word turns up
+// within SyncSeekWindow bytes.
+func (s *Mp3Stream) Next() (*Mp3FrameHeader, error) {
+	if s.lastFrameStart >= 0 && s.lastFrameSize > 0 {
+		hdr, err := s.frameAt(s.lastFrameStart + s.lastFrameSize)
+		switch err {
+		case nil:
+			return hdr, nil
+		case ErrCRCMismatch:
+			return nil, err
+		}
+	}
+
+	return s.resync()
+}
+
+// frameAt returns the frame header at offset i, recording it as the
+// new resync point for the next call to Next(). It returns
+// errNotFrame if i doesn't hold a plausible header, or ErrCRCMismatch
+// if it does but fails CRC verification under StrictCRC.
+func (s *Mp3Stream) frameAt(i int) (*Mp3FrameHeader, error) {
+	if i+4 > s.end || s.buf[i] != 0xFF || s.buf[i+1]&0xE0 != 0xE0 {
+		return nil, errNotFrame
+	}
+
+	hdr := DeserializeFrame(reverseHeader(s.buf[i : i+4]))
+	if !hdr.valid() {
+		return nil, errNotFrame
+	}
+
+	// sideInfoSize (and therefore VerifyCRC) only knows the Layer III
+	// side-information layout; Layer I/II protected frames are
+	// followed by bit-allocation/scalefactor data of a different size
+	// entirely, so there's nothing to verify them against here.
+	if hdr.CrcProtected == 0 && hdr.LayerDesc == 1 {
+		size := sideInfoSize(hdr)
+		if i+6+size <= s.end {
+			if err := hdr.VerifyCRC(Mp3Frame(s.buf[i : i+6+size])); err != nil {
+				if s.StrictCRC {
+					return nil, ErrCRCMismatch
+				}
+				return nil, errNotFrame
+			}
+		}
+	}
+
+	s.pos = i + 4
+	s.lastFrameStart = i
+	s.lastFrameSize = hdr.FrameSize()
+	return &hdr, nil
+}
+
+// FrameStart returns the offset into the stream's backing bytes
+// where the most recently returned frame's header began.
+func (s *Mp3Stream) FrameStart() int {
+	return s.lastFrameStart
+}
+
+// resync performs the bounded sync-seek described by Next(), scanning
+// byte-by-byte from s.pos for the next plausible frame header.
+func (s *Mp3Stream) resync() (*Mp3FrameHeader, error) {
+	limit := s.pos + SyncSeekWindow
+	if limit > s.end {
+		limit = s.end
+	}
+
+	for i := s.pos; i+4 <= s.end && i < limit; i++ {
+		hdr, err := s.frameAt(i)
+		switch err {
+		case nil:
+			return hdr, nil
+		case ErrCRCMismatch:
+			return nil, err
+		}
+	}
+
+	// If the scan reached all the way to the stream's end without the
+	// bounded window cutting it short, there's nothing left to find.
+	if limit >= s.end {
+		return nil, io.EOF
+	}
+
+	return nil, ErrSyncNotFound
+}
+
+// valid reports whether hdr's bitrate, sample-rate and layer fields
+// are all non-reserved, i.e. this is plausibly a real frame header
+// and not a false sync match found in the middle of audio data.
+func (hdr *Mp3FrameHeader) valid() bool {
+	return hdr.LayerDesc != 0 && hdr.Srfi != 3 &&
+		hdr.BitrateIdx != 0xF && hdr.AudioVer != 1
+}
+
+var ErrReservedIndex = errors.New("splotr: reserved bitrate, sample-rate or layer index")
+
+// bitrateTableV1 holds the MPEG1 bitrate table in kbps, indexed
+// [layerRow][BitrateIdx]. Row 0 is Layer III, row 1 is Layer II, row
+// 2 is Layer I, matching LayerDesc - 1.
+var bitrateTableV1 = [3][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}, // Layer III
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0}, // Layer II
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}, // Layer I
+}
+
+// bitrateTableV2 holds the MPEG2/MPEG2.5 bitrate table in kbps,
+// indexed the same way as bitrateTableV1.
+var bitrateTableV2 = [3][16]int{
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}, // Layer III
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}, // Layer II
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}, // Layer I
+}
+
+// sampleRateTable holds the sample rate in Hz, indexed
+// [versionRow][Srfi]. Row 0 is MPEG1, row 1 is MPEG2, row 2 is
+// MPEG2.5.
+var sampleRateTable = [3][3]int{
+	{44100, 48000, 32000}, // MPEG1
+	{22050, 24000, 16000}, // MPEG2
+	{11025, 12000, 8000},  // MPEG2.5
+}
+
+// layerRow maps LayerDesc (2=Layer II, 3=Layer I, 1=Layer III) to a
+// bitrateTable row index, or -1 if LayerDesc is reserved (0).
+func (h Mp3FrameHeader) layerRow() int {
+	return int(h.LayerDesc) - 1
+}
+
+// versionRow maps AudioVer (3=MPEG1, 2=MPEG2, 0=MPEG2.5) to a
+// sampleRateTable row index. AudioVer == 1 is reserved and is
+// expected to already have been filtered out by valid().
+func (h Mp3FrameHeader) versionRow() int {
+	switch h.AudioVer {
+	case 3:
+		return 0
+	case 2:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Bitrate returns h's bitrate in kbps, or 0 for the "free" bitrate
+// index (0) or a reserved layer index.
+func (h Mp3FrameHeader) Bitrate() int {
+	row := h.layerRow()
+	if row < 0 || row > 2 {
+		return 0
+	}
+
+	if h.AudioVer == 3 {
+		return bitrateTableV1[row][h.BitrateIdx]
+	}
+
+	return bitrateTableV2[row][h.BitrateIdx]
+}
+
+// SampleRate returns h's sample rate in Hz, or 0 if Srfi is
+// reserved (3).
+func (h Mp3FrameHeader) SampleRate() int {
+	if h.Srfi == 3 {
+		return 0
+	}
+
+	return sampleRateTable[h.versionRow()][h.Srfi]
+}
+
+// SamplesPerFrame returns the number of PCM samples encoded by a
+// single frame of h's layer and version: 384 for Layer I, 1152 for
+// Layer II, and 1152 (MPEG1) or 576 (MPEG2/2.5) for Layer III.
+func (h Mp3FrameHeader) SamplesPerFrame() int {
+	switch h.LayerDesc {
+	case 3: // Layer I
+		return 384
+	case 2: // Layer II
+		return 1152
+	case 1: // Layer III
+		if h.AudioVer == 3 {
+			return 1152
+		}
+		return 576
+	default:
+		return 0
+	}
+}
+
+// FrameSize returns the total size of the frame in bytes, header
+// included, using FrameSize = SamplesPerFrame/8 * Bitrate / SampleRate
+// + Padding, counted in whole slots, with Layer I using a 4-byte slot
+// size instead of 1. It returns 0 for free-format or otherwise
+// unresolvable headers.
+func (h Mp3FrameHeader) FrameSize() int {
+	bitrate := h.Bitrate()
+	rate := h.SampleRate()
+	if bitrate == 0 || rate == 0 {
+		return 0
+	}
+
+	slotSize := 1
+	if h.LayerDesc == 3 {
+		slotSize = 4
+	}
+
+	slots := h.SamplesPerFrame() / 8 / slotSize * bitrate * 1000 / rate
+	return (slots + int(h.IsPadded)) * slotSize
+}
+
+// Duration returns the length of time, in seconds, that a single
+// frame of h represents. It returns ErrReservedIndex if h's bitrate,
+// sample-rate or layer fields are reserved.
+func (h Mp3FrameHeader) Duration() (float64, error) {
+	if !h.valid() {
+		return 0, ErrReservedIndex
+	}
+
+	return float64(h.SamplesPerFrame()) / float64(h.SampleRate()), nil
+}
+
+// VBRKind identifies which VBR header variant was found in a frame.
+type VBRKind uint8
+
+const (
+	VBRNone VBRKind = iota // No VBR header present (CBR, or none found)
+	VBRXing                // "Xing" tag (true VBR)
+	VBRInfo                // "Info" tag (written by LAME for CBR/ABR files)
+	VBRVBRI                // "VBRI" tag (Fraunhofer encoders)
+)
+
+// vbriOffset is the fixed distance from the start of a frame (its
+// 4-byte header included) to a VBRI tag, regardless of CRC
+// protection or channel mode.
+const vbriOffset = 4 + 32
+
+// VBRHeader holds the decoded contents of a Xing/Info/VBRI header
+// found in the side-info area of a file's first frame.
+type VBRHeader struct {
+	Kind    VBRKind
+	Frames  uint32
+	Bytes   uint32
+	TOC     [100]byte
+	Quality uint32
+}
+
+// VBR returns f's VBR header, or nil if the first frame didn't carry
+// a Xing/Info/VBRI tag.
+func (f *Mp3File) VBR() *VBRHeader {
+	return f.vbr
+}
+
+// Seek returns a rough byte offset into f.Contents corresponding to
+// percent (0-100) of the way through playback. When a Xing/Info TOC
+// is available it's used for a non-linear estimate; otherwise (and
+// for VBRI files, whose TOC isn't percent-scaled the same way) Seek
+// falls back to a straight linear estimate over the file size.
+func (f *Mp3File) Seek(percent float64) int64 {
+	total := float64(len(f.Contents))
+
+	if f.vbr == nil || f.vbr.Kind == VBRVBRI || f.vbr.TOC == [100]byte{} {
+		return int64(percent / 100 * total)
+	}
+
+	if percent < 0 {
+		percent = 0
+	} else if percent > 99 {
+		percent = 99
+	}
+
+	frac := float64(f.vbr.TOC[int(percent)]) / 256.0
+	return int64(frac * total)
+}
+
+// sideInfoSize returns the size, in bytes, of the side-information
+// block that immediately follows a frame's header (and CRC, if
+// present), which is what separates the header from a Xing/Info tag.
+func sideInfoSize(hdr Mp3FrameHeader) int {
+	mono := hdr.ChannelMode == 3
+
+	if hdr.AudioVer == 3 { // MPEG1
+		if mono {
+			return 17
+		}
+		return 32
+	}
+
+	if mono { // MPEG2/2.5
+		return 9
+	}
+	return 17
+}
+
+// ErrCRCMismatch is returned by VerifyCRC when a frame's stored
+// CRC-16 doesn't match the one computed over its protected bytes.
+var ErrCRCMismatch = errors.New("splotr: frame CRC-16 mismatch")
+
+const crc16Poly = 0x8005 // Standard MPEG audio CRC-16 polynomial
+
+// crc16 computes the MPEG audio CRC-16 (poly 0x8005, initial value
+// 0xFFFF, MSB-first) over data.
+func crc16(data []byte) uint16 {
+	var crc uint16 = 0xFFFF
+
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ crc16Poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// VerifyCRC recomputes the CRC-16 covering the last two bytes of h's
+// header plus the side-information block, and compares it against
+// the stored CRC in the two bytes immediately following the header
+// in frame (frame in natural file byte order, header included). It
+// is only meaningful when h.CrcProtected == 0.
+func (h Mp3FrameHeader) VerifyCRC(frame Mp3Frame) error {
+	size := sideInfoSize(h)
+	if len(frame) < 6+size {
+		return ErrCRCMismatch
+	}
+
+	stored := uint16(frame[4])<<8 | uint16(frame[5])
+
+	protected := make([]byte, 0, 2+size)
+	protected = append(protected, frame[2:4]...)
+	protected = append(protected, frame[6:6+size]...)
+
+	if crc16(protected) != stored {
+		return ErrCRCMismatch
+	}
+
+	return nil
+}
+
+// parseVBRHeader looks for a VBRI tag at its fixed offset, then a
+// Xing/Info tag just past the side-info block, within the frame of
+// hdr starting at frameStart in data. It returns nil if neither tag
+// is present.
+func parseVBRHeader(data []byte, frameStart int, hdr Mp3FrameHeader) *VBRHeader {
+	if off := frameStart + vbriOffset; off+4 <= len(data) && bytes.Equal(data[off:off+4], []byte("VBRI")) {
+		return decodeVBRI(data[off:])
+	}
+
+	crcBytes := 0
+	if hdr.CrcProtected == 0 {
+		crcBytes = 2
+	}
+
+	off := frameStart + 4 + crcBytes + sideInfoSize(hdr)
+	if off+4 > len(data) {
+		return nil
+	}
+
+	switch string(data[off : off+4]) {
+	case "Xing":
+		return decodeXing(data[off:], VBRXing)
+	case "Info":
+		return decodeXing(data[off:], VBRInfo)
+	default:
+		return nil
+	}
+}
+
+// decodeXing decodes a Xing/Info header, whose layout after the
+// 4-byte tag is a 4-byte flags field followed by whichever of
+// frame count, byte count, TOC and quality the flags declare present,
+// in that order, each big-endian.
+func decodeXing(b []byte, kind VBRKind) *VBRHeader {
+	if len(b) < 8 {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint32(b[4:8])
+	vh := &VBRHeader{Kind: kind}
+	off := 8
+
+	if flags&0x1 != 0 && off+4 <= len(b) {
+		vh.Frames = binary.BigEndian.Uint32(b[off : off+4])
+		off += 4
+	}
+
+	if flags&0x2 != 0 && off+4 <= len(b) {
+		vh.Bytes = binary.BigEndian.Uint32(b[off : off+4])
+		off += 4
+	}
+
+	if flags&0x4 != 0 && off+100 <= len(b) {
+		copy(vh.TOC[:], b[off:off+100])
+		off += 100
+	}
+
+	if flags&0x8 != 0 && off+4 <= len(b) {
+		vh.Quality = binary.BigEndian.Uint32(b[off : off+4])
+	}
+
+	return vh
+}
+
+// decodeVBRI decodes a Fraunhofer VBRI header, whose fixed-size
+// fields precede a TOC whose entry size and count are themselves
+// part of the header.
+func decodeVBRI(b []byte) *VBRHeader {
+	if len(b) < 26 {
+		return nil
+	}
+
+	vh := &VBRHeader{Kind: VBRVBRI}
+	vh.Quality = uint32(binary.BigEndian.Uint16(b[8:10]))
+	vh.Bytes = binary.BigEndian.Uint32(b[10:14])
+	vh.Frames = binary.BigEndian.Uint32(b[14:18])
+
+	tocEntries := int(binary.BigEndian.Uint16(b[18:20]))
+	tocEntrySize := int(binary.BigEndian.Uint16(b[22:24]))
+	tocLen := tocEntries * tocEntrySize
+	tocStart := 26
+
+	if tocStart+tocLen <= len(b) {
+		n := tocLen
+		if n > len(vh.TOC) {
+			n = len(vh.TOC)
+		}
+		copy(vh.TOC[:], b[tocStart:tocStart+n])
+	}
+
+	return vh
+}
+
+// Decode does not produce real PCM yet: the decoder subpackage parses
+// Layer III side info but does not implement the ISO/IEC 11172-3
+// Huffman tables or synthesis filter, so there is nothing valid to
+// buffer. It returns decoder.ErrApproximateOnly (passed back
+// unchanged from DecodeFrames) once it reaches the first MPEG1 Layer
+// III frame; a file with no such frame yields nil PCM and a nil error.
+// Kept as the batching counterpart to DecodeFrames for when that gap
+// is filled.
+func (f *Mp3File) Decode() ([]int16, error) {
+	var pcm []int16
+
+	err := f.DecodeFrames(func(samples []int16) error {
+		pcm = append(pcm, samples...)
+		return nil
+	})
+
+	return pcm, err
+}
+
+// DecodeFrames does not produce real PCM yet. It walks f's Layer III
+// frames and hands each to the decoder subpackage, but that package
+// only implements side-info parsing (see its doc comment) and returns
+// decoder.ErrApproximateOnly instead of fabricated samples, so fn is
+// never actually called with real Layer III audio today. Frames of
+// any other layer or MPEG version are skipped outright, since the
+// decoder subpackage only targets MPEG1 Layer III.
+func (f *Mp3File) DecodeFrames(fn func([]int16) error) error {
+	stream, err := NewMp3Stream(bytes.NewReader(f.Contents))
+	if err != nil {
+		return err
+	}
+
+	dec := decoder.NewDecoder()
+
+	for {
+		hdr, err := stream.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.LayerDesc != 1 || hdr.AudioVer != 3 {
+			continue
+		}
+
+		start := stream.FrameStart()
+		size := hdr.FrameSize()
+		if size == 0 || start+size > len(f.Contents) {
+			continue
+		}
+
+		fi := decoder.FrameInfo{
+			ChannelMode:  hdr.ChannelMode,
+			ModeExt:      hdr.ModeExt,
+			CrcProtected: hdr.CrcProtected,
+			Mono:         hdr.ChannelMode == 3,
+		}
+
+		samples, err := dec.DecodeFrame(fi, f.Contents[start:start+size])
+		if err == decoder.ErrApproximateOnly {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+
+		if err := fn(samples); err != nil {
+			return err
+		}
+	}
+}
+
+// Waveform decodes f and downsamples the result into width
+// peak-per-bucket samples in [-1, 1], suitable for an ASCII or SVG
+// plot. It returns the error from Decode unchanged on failure --
+// which is decoder.ErrApproximateOnly for every file holding an
+// MPEG1 Layer III frame (see Decode) -- so callers can tell "not implemented yet" apart from other
+// failures instead of just getting nil back either way.
+func (f *Mp3File) Waveform(width int) ([]float32, error) {
+	pcm, err := f.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 || len(pcm) == 0 {
+		return nil, nil
+	}
+
+	bucket := len(pcm) / width
+	if bucket == 0 {
+		bucket = 1
+	}
+
+	out := make([]float32, width)
+	for i := 0; i < width; i++ {
+		start := i * bucket
+		end := start + bucket
+		if end > len(pcm) {
+			end = len(pcm)
+		}
+
+		var peak int16
+		for _, s := range pcm[start:end] {
+			mag := s
+			if mag < 0 {
+				mag = -mag
+			}
+			if mag > peak {
+				peak = mag
+			}
+		}
+
+		out[i] = float32(peak) / 32768
+	}
+
+	return out, nil
+}
+
+// reverseHeader flips a 4-byte slice read in natural file order into
+// the order DeserializeFrame() expects, where fr[0] is the header's
+// last byte and fr[3] is its first.
+func reverseHeader(b []byte) Mp3Frame {
+	return Mp3Frame{b[3], b[2], b[1], b[0]}
+}
+
+// skipId3v2 returns the length of a leading ID3v2 header, or 0 if
+// data does not start with one. The size field occupies bytes 6-9
+// and is syncsafe (28 bits spread across 4 bytes, top bit of each
+// byte unused).
+func skipId3v2(data []byte) int {
+	if len(data) < 10 || string(data[0:3]) != "ID3" {
+		return 0
+	}
+
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 |
+		int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	return 10 + size
+}
+
+// apeFooterSize is the fixed size, in bytes, of an APEv2 tag's
+// footer (preamble, version, tag size, item count, flags, reserved).
+const apeFooterSize = 32
+
+// trailingTagStart returns the offset of the first byte belonging to
+// a trailing ID3v1 and/or APEv2 tag, or len(data) if neither is
+// present. An APEv2 footer sits immediately before the ID3v1 tag (if
+// one follows it), so the ID3v1 check runs first and the APE check
+// runs against whatever is left. The APE tag's body (which can run to
+// several KiB of item data) sits before its footer, so the footer's
+// little-endian "tag size" field -- which counts the whole tag
+// including the footer itself, but excluding any separate header --
+// is used to exclude the entire tag, not just the footer.
+func trailingTagStart(data []byte) int {
+	end := len(data)
+
+	if end >= 128 && string(data[end-128:end-125]) == "TAG" {
+		end -= 128
+	}
+
+	if end >= apeFooterSize && bytes.HasPrefix(data[end-apeFooterSize:], []byte("APETAGEX")) {
+		footer := data[end-apeFooterSize : end]
+		tagSize := int(binary.LittleEndian.Uint32(footer[12:16]))
+
+		if tagSize < apeFooterSize || tagSize > end {
+			tagSize = apeFooterSize
+		}
+
+		end -= tagSize
+	}
+
+	return end
+}
+
+//
+// Mp3Tags holds the metadata fields common to both ID3v1 and ID3v2,
+// normalized into plain strings regardless of which tag format (or
+// text encoding, for ID3v2) they were read from. When both tags are
+// present, ID3v2 fields win wherever they're non-empty, since ID3v2
+// isn't length-limited and is usually the more complete of the two.
+//
+type Mp3Tags struct {
+	Title   string
+	Artist  string
+	Album   string
+	Year    string
+	Comment string
+	Genre   string
+	Track   string
+	frames  map[string]string // raw ID3v2 frame ID -> decoded text, for Tag()
+}
+
+// id3v1Genre is the standard ID3v1 genre list, indexed by the single
+// genre byte at the end of the tag. Anything outside this range is
+// unassigned.
+var id3v1Genre = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel",
+	"Noise", "AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
+
+// trimID3v1 trims trailing NUL and space padding from a fixed-width
+// ID3v1 text field.
+func trimID3v1(b []byte) string {
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// parseID3v1 reads the trailing 128-byte ID3v1 tag, if one is
+// present, and returns its fields. It recognizes the common ID3v1.1
+// extension, where a zero byte followed by a non-zero byte at the
+// end of the comment field means the last byte is a track number
+// rather than part of the comment.
+func parseID3v1(data []byte) *Mp3Tags {
+	if len(data) < 128 {
+		return nil
+	}
+
+	tail := data[len(data)-128:]
+	if string(tail[0:3]) != "TAG" {
+		return nil
+	}
+
+	t := &Mp3Tags{}
+	t.Title = trimID3v1(tail[3:33])
+	t.Artist = trimID3v1(tail[33:63])
+	t.Album = trimID3v1(tail[63:93])
+	t.Year = trimID3v1(tail[93:97])
+
+	comment := tail[97:127]
+	if comment[28] == 0 && comment[29] != 0 {
+		t.Comment = trimID3v1(comment[:28])
+		t.Track = fmt.Sprintf("%d", comment[29])
+	} else {
+		t.Comment = trimID3v1(comment)
+	}
+
+	if genre := int(tail[127]); genre >= 0 && genre < len(id3v1Genre) {
+		t.Genre = id3v1Genre[genre]
+	}
+
+	return t
+}
+
+// deunsync reverses ID3v2 unsynchronisation: every "0xFF 0x00" byte
+// pair in the tag body is collapsed back down to a lone 0xFF. This is
+// only applied when the tag header's unsynchronisation flag is set.
+func deunsync(body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		out = append(out, body[i])
+		if body[i] == 0xFF && i+1 < len(body) && body[i+1] == 0x00 {
+			i++
+		}
+	}
+	return out
+}
+
+// decodeID3Text decodes an ID3v2 text frame's payload, whose first
+// byte is a text-encoding marker:
+//     0 - ISO-8859-1
+//     1 - UTF-16 with a leading byte-order mark
+//     2 - UTF-16BE, no byte-order mark
+//     3 - UTF-8
+func decodeID3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	enc := data[0]
+	text := data[1:]
+
+	switch enc {
+	case 1:
+		return decodeUTF16(text, true)
+	case 2:
+		return decodeUTF16(text, false)
+	case 3:
+		return strings.TrimRight(string(text), "\x00")
+	default:
+		// ISO-8859-1: every byte maps directly onto the Unicode
+		// code point of the same value.
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		return strings.TrimRight(string(runes), "\x00")
+	}
+}
+
+// decodeUTF16 decodes a UTF-16 text frame payload. If bom is set, a
+// leading byte-order mark (if present) selects little- or
+// big-endian; otherwise big-endian is assumed, per the ID3v2 spec
+// for encoding 2. Surrogate pairs are not reassembled, which only
+// matters for characters outside the Basic Multilingual Plane.
+func decodeUTF16(b []byte, bom bool) string {
+	start := 0
+	bigEndian := true
+
+	if bom && len(b) >= 2 {
+		switch {
+		case b[0] == 0xFE && b[1] == 0xFF:
+			bigEndian = true
+			start = 2
+		case b[0] == 0xFF && b[1] == 0xFE:
+			bigEndian = false
+			start = 2
+		}
+	}
+
+	var runes []rune
+	for i := start; i+1 < len(b); i += 2 {
+		var u uint16
+		if bigEndian {
+			u = uint16(b[i])<<8 | uint16(b[i+1])
+		} else {
+			u = uint16(b[i+1])<<8 | uint16(b[i])
+		}
+		if u == 0 {
+			break
+		}
+		runes = append(runes, rune(u))
+	}
+
+	return string(runes)
+}
+
+// isFrameID reports whether id looks like a valid ID3v2 frame ID:
+// four uppercase letters or digits. Padding at the end of a tag is
+// all zero bytes, which fails this check and tells parseID3v2 where
+// to stop.
+func isFrameID(id string) bool {
+	for _, c := range []byte(id) {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseID3v2 reads a leading ID3v2.3 or ID3v2.4 tag, if one is
+// present, decoding every text frame it finds into t.frames and
+// lifting the handful of well-known frames (title, artist, etc.)
+// into Mp3Tags' named fields.
+func parseID3v2(data []byte) *Mp3Tags {
+	if len(data) < 10 || string(data[0:3]) != "ID3" {
+		return nil
+	}
+
+	flags := data[5]
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 |
+		int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+
+	if 10+size > len(data) {
+		return nil
+	}
+	body := data[10 : 10+size]
+
+	// Unsynchronisation: 0xFF 0x00 pairs throughout the body are
+	// really a lone 0xFF, escaped so it can't be mistaken for an
+	// MPEG frame sync by a naive scanner.
+	if flags&0x80 != 0 {
+		body = deunsync(body)
+	}
+
+	pos := 0
+
+	// Extended header: we only need its length to skip over it; the
+	// extra fields it carries (CRC, restrictions, ...) don't matter
+	// for tag reading.
+	if flags&0x40 != 0 && len(body) >= 4 {
+		if data[3] == 3 {
+			// ID3v2.3: a plain size that excludes its own 4 bytes.
+			pos = 4 + int(binary.BigEndian.Uint32(body[0:4]))
+		} else {
+			// ID3v2.4: a syncsafe size that covers the whole header.
+			pos = int(body[0]&0x7F)<<21 | int(body[1]&0x7F)<<14 |
+				int(body[2]&0x7F)<<7 | int(body[3]&0x7F)
+		}
+	}
+
+	t := &Mp3Tags{frames: map[string]string{}}
+
+	for pos+10 <= len(body) {
+		id := string(body[pos : pos+4])
+		if !isFrameID(id) {
+			break // padding reached
+		}
+
+		fsize := int(body[pos+4])<<24 | int(body[pos+5])<<16 |
+			int(body[pos+6])<<8 | int(body[pos+7])
+		if data[3] == 4 { // ID3v2.4 frame sizes are syncsafe
+			fsize = int(body[pos+4]&0x7F)<<21 | int(body[pos+5]&0x7F)<<14 |
+				int(body[pos+6]&0x7F)<<7 | int(body[pos+7]&0x7F)
+		}
+		pos += 10
+
+		if fsize < 0 || pos+fsize > len(body) {
+			break
+		}
+
+		text := decodeID3Text(body[pos : pos+fsize])
+		t.frames[id] = text
+
+		switch id {
+		case "TIT2":
+			t.Title = text
+		case "TPE1":
+			t.Artist = text
+		case "TALB":
+			t.Album = text
+		case "TYER", "TDRC":
+			t.Year = text
+		case "COMM":
+			t.Comment = text
+		case "TCON":
+			t.Genre = text
+		case "TRCK":
+			t.Track = text
+		}
+
+		pos += fsize
+	}
+
+	return t
+}
+
+// mergeTags combines an ID3v2 and ID3v1 reading of the same file.
+// ID3v1 supplies the base (it's all we have if there's no ID3v2
+// tag), and any non-empty ID3v2 field overrides it.
+func mergeTags(v2, v1 *Mp3Tags) Mp3Tags {
+	var out Mp3Tags
+	if v1 != nil {
+		out = *v1
+	}
+
+	if v2 != nil {
+		if v2.Title != "" {
+			out.Title = v2.Title
+		}
+		if v2.Artist != "" {
+			out.Artist = v2.Artist
+		}
+		if v2.Album != "" {
+			out.Album = v2.Album
+		}
+		if v2.Year != "" {
+			out.Year = v2.Year
+		}
+		if v2.Comment != "" {
+			out.Comment = v2.Comment
+		}
+		if v2.Genre != "" {
+			out.Genre = v2.Genre
+		}
+		if v2.Track != "" {
+			out.Track = v2.Track
+		}
+		out.frames = v2.frames
+	}
+
+	return out
 }
 
 // Common types
@@ -127,15 +1107,7 @@ func Load(path Mp3Path) (*Mp3File, error) {
 		return nil, err
 	}
 
-	// If the file is not empty then we'll strip the
-	// trailing newline
-	if len(data) > 0 {
-		data[len(data) - 1] = '\x00'
-	}
-
 	handle.Path = Mp3Path(path)
-	handle.DurationMin = 0
-	handle.DurationSec = 0
 
 	// Attempt to fetch how big the file is.
 	filesize, err = GetFileSize(handle.Path)
@@ -145,7 +1117,18 @@ func Load(path Mp3Path) (*Mp3File, error) {
 
 	handle.Size = filesize
 	handle.Contents = data
-	frame := DeserializeFrame(Mp3Frame(data))
+	handle.Tags = mergeTags(parseID3v2(data), parseID3v1(data))
+
+	stream, err := NewMp3Stream(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := stream.Next()
+	if err != nil {
+		fmt.Println("error: failed to find a valid MP3 frame in", path)
+		return nil, err
+	}
 
 	// Is this an original copy?
 	if frame.Original == 1 {
@@ -161,9 +1144,36 @@ func Load(path Mp3Path) (*Mp3File, error) {
 		copyrstr = "no"
 	}
 
+	handle.vbr = parseVBRHeader(data, stream.FrameStart(), *frame)
+
+	var totalSec float64
+	if vbr := handle.vbr; vbr != nil && vbr.Frames > 0 {
+		// O(1) duration: trust the VBR header's frame count instead
+		// of walking every frame.
+		totalSec = float64(vbr.Frames) * float64(frame.SamplesPerFrame()) / float64(frame.SampleRate())
+	} else {
+		// No VBR header; walk the rest of the stream, summing each
+		// frame's duration to get the file's real total duration.
+		for f := frame; f != nil; f, _ = stream.Next() {
+			if d, derr := f.Duration(); derr == nil {
+				totalSec += d
+			}
+		}
+	}
+
+	handle.DurationMin = Mp3Dur(totalSec) / 60
+	handle.DurationSec = Mp3Dur(totalSec) % 60
+
 	fmt.Println("Emphasis: ", frame.Emphasis)
 	fmt.Println("Original copy: ", origstr)
 	fmt.Println("Is copyrighted: ", copyrstr)
+	fmt.Println("Title: ", handle.Tags.Title)
+	fmt.Println("Artist: ", handle.Tags.Artist)
+	fmt.Println("Album: ", handle.Tags.Album)
+	fmt.Println("Year: ", handle.Tags.Year)
+	fmt.Println("Track: ", handle.Tags.Track)
+	fmt.Println("Genre: ", handle.Tags.Genre)
+	fmt.Println("Comment: ", handle.Tags.Comment)
 	return handle, nil
 }
 
@@ -227,10 +1237,44 @@ func main() {
 	}
 
 	path := Mp3Path(os.Args[1])
-	_, err := Load(path)
+	handle, err := Load(path)
 
 	if err != nil {
 		fmt.Println("Could not find ", string(path))
 		panic("bailing")
 	}
+
+	PlotWaveform(handle, 64)
+}
+
+// waveformLevels are the characters PlotWaveform draws bars out of,
+// from quietest to loudest.
+var waveformLevels = []rune(" .:-=+*#%@")
+
+// PlotWaveform prints a width-column ASCII bar plot of handle's
+// waveform, one character tall per bucket, so splotr actually plots
+// something.
+func PlotWaveform(handle *Mp3File, width int) {
+	samples, err := handle.Waveform(width)
+	if err == decoder.ErrApproximateOnly {
+		fmt.Println("(Layer III decoding isn't implemented yet -- nothing to plot)")
+		return
+	}
+	if err != nil || samples == nil {
+		fmt.Println("(no waveform available)")
+		return
+	}
+
+	var b strings.Builder
+	for _, s := range samples {
+		idx := int(s * float32(len(waveformLevels)-1))
+		if idx < 0 {
+			idx = 0
+		} else if idx >= len(waveformLevels) {
+			idx = len(waveformLevels) - 1
+		}
+		b.WriteRune(waveformLevels[idx])
+	}
+
+	fmt.Println(b.String())
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TestTrailingTagStartExcludesFullAPEBody guards against only the
+// fixed 32-byte APEv2 footer being excluded from the scan range,
+// leaving the (often much larger) tag body that precedes it exposed
+// to resync().
+func TestTrailingTagStartExcludesFullAPEBody(t *testing.T) {
+	const bodySize = 500
+	tagSize := bodySize + apeFooterSize // per spec, excludes any separate header
+
+	data := make([]byte, bodySize+apeFooterSize)
+	copy(data[bodySize:], []byte("APETAGEX"))
+	binary.LittleEndian.PutUint32(data[bodySize+8:], 2000)             // version
+	binary.LittleEndian.PutUint32(data[bodySize+12:], uint32(tagSize)) // tag size
+
+	got := trailingTagStart(data)
+	if got != 0 {
+		t.Fatalf("trailingTagStart() = %d, want 0 (whole buffer is the APE tag)", got)
+	}
+}
+
+// TestTrailingTagStartNoAPETag ensures plain files without a trailing
+// tag are left untouched.
+func TestTrailingTagStartNoAPETag(t *testing.T) {
+	data := make([]byte, 100)
+	if got := trailingTagStart(data); got != len(data) {
+		t.Fatalf("trailingTagStart() = %d, want %d", got, len(data))
+	}
+}
+
+// TestFrameAtSkipsCRCForNonLayerIII guards against applying the Layer
+// III side-information size/layout to a CRC-protected Layer I/II
+// frame, which has a differently-shaped bit-allocation block and
+// would otherwise always fail CRC verification.
+func TestFrameAtSkipsCRCForNonLayerIII(t *testing.T) {
+	// MPEG1 Layer II, CRC-protected, followed by 2 garbage "CRC" bytes
+	// and a side-info-sized block of zeros that would never satisfy
+	// VerifyCRC's Layer III checksum.
+	data := []byte{0xFF, 0xFC, 0x50, 0x00, 0xAB, 0xCD}
+	data = append(data, make([]byte, 40)...)
+
+	s := &Mp3Stream{buf: data, end: len(data)}
+
+	hdr, err := s.frameAt(0)
+	if err != nil {
+		t.Fatalf("frameAt() returned error %v, want a Layer II frame accepted without CRC verification", err)
+	}
+	if hdr.LayerDesc != 2 {
+		t.Fatalf("hdr.LayerDesc = %d, want 2 (Layer II)", hdr.LayerDesc)
+	}
+}